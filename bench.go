@@ -0,0 +1,278 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// benchOpts configures a nats-bench run.
+type benchOpts struct {
+	subj     string
+	msgCount int
+	msgSize  int
+	numPubs  int
+	numSubs  int
+	mode     string // "pub", "sub", "req" or "pubsub"
+	queue    string
+	useJS    bool
+}
+
+// benchStats is what a single publisher/subscriber/requester goroutine
+// reports back when it finishes.
+type benchStats struct {
+	kind      string
+	id        int
+	count     int
+	bytes     int64
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+// runBench drives the publish/subscribe/request loops described by o and
+// prints a throughput and latency report once they complete.
+func runBench(nc *nats.Conn, js nats.JetStreamContext, o benchOpts) {
+	var wg sync.WaitGroup
+	results := make(chan benchStats, o.numPubs+o.numSubs)
+	subsDone := make(chan struct{})
+
+	runSubs := o.mode == "sub" || o.mode == "pubsub"
+	runPubs := o.mode == "pub" || o.mode == "pubsub"
+	runReqs := o.mode == "req"
+
+	if runSubs {
+		for i := 0; i < o.numSubs; i++ {
+			wg.Add(1)
+			go benchSubscriber(nc, js, o, i, &wg, results, subsDone)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var producers sync.WaitGroup
+	if runPubs {
+		for i := 0; i < o.numPubs; i++ {
+			wg.Add(1)
+			producers.Add(1)
+			go benchPublisher(nc, js, o, i, &wg, &producers, results)
+		}
+	}
+	if runReqs {
+		for i := 0; i < o.numPubs; i++ {
+			wg.Add(1)
+			producers.Add(1)
+			go benchRequester(nc, o, i, &wg, &producers, results)
+		}
+	}
+	producers.Wait()
+
+	if runSubs {
+		nc.Flush()
+		time.Sleep(500 * time.Millisecond)
+		close(subsDone)
+	}
+	wg.Wait()
+	close(results)
+
+	var all []benchStats
+	for s := range results {
+		all = append(all, s)
+	}
+	reportBench(all)
+}
+
+// benchPublisher fires msgCount/numPubs messages at subj, stamping the
+// send time into the payload (when it's large enough) so a matching
+// subscriber can compute end-to-end latency.
+func benchPublisher(nc *nats.Conn, js nats.JetStreamContext, o benchOpts, id int, wg, producers *sync.WaitGroup, out chan<- benchStats) {
+	defer wg.Done()
+	defer producers.Done()
+
+	n := o.msgCount / o.numPubs
+	payload := make([]byte, o.msgSize)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if len(payload) >= 8 {
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		}
+		if o.useJS {
+			if _, err := js.Publish(o.subj, payload); err != nil {
+				log.Printf("pub[%d]: %v", id, err)
+			}
+		} else {
+			nc.Publish(o.subj, payload)
+		}
+	}
+	nc.Flush()
+	out <- benchStats{kind: "pub", id: id, count: n, bytes: int64(n) * int64(o.msgSize), elapsed: time.Since(start)}
+}
+
+// benchSubscriber counts messages received on subj until subsDone is
+// closed, recovering a latency sample from any payload big enough to
+// carry the publisher's send-time stamp.
+func benchSubscriber(nc *nats.Conn, js nats.JetStreamContext, o benchOpts, id int, wg *sync.WaitGroup, out chan<- benchStats, subsDone <-chan struct{}) {
+	defer wg.Done()
+
+	msgCh := make(chan *nats.Msg, 1024)
+	handler := func(msg *nats.Msg) { msgCh <- msg }
+
+	var unsubscribe func()
+	if o.useJS {
+		stop, err := jsSubscribe(js, o.subj, "", 30*time.Second, func(msg *nats.Msg) {
+			msgCh <- msg
+			msg.Ack()
+		})
+		if err != nil {
+			log.Printf("sub[%d]: %v", id, err)
+			out <- benchStats{kind: "sub", id: id}
+			return
+		}
+		unsubscribe = stop
+	} else {
+		var sub *nats.Subscription
+		var err error
+		if o.queue != "" {
+			sub, err = nc.QueueSubscribe(o.subj, o.queue, handler)
+		} else {
+			sub, err = nc.Subscribe(o.subj, handler)
+		}
+		if err != nil {
+			log.Printf("sub[%d]: %v", id, err)
+			out <- benchStats{kind: "sub", id: id}
+			return
+		}
+		unsubscribe = func() { sub.Unsubscribe() }
+	}
+	defer unsubscribe()
+
+	start := time.Now()
+	var count int
+	var bytes int64
+	var latencies []time.Duration
+	accumulate := func(msg *nats.Msg) {
+		count++
+		bytes += int64(len(msg.Data))
+		if len(msg.Data) >= 8 {
+			sent := int64(binary.BigEndian.Uint64(msg.Data[:8]))
+			latencies = append(latencies, time.Since(time.Unix(0, sent)))
+		}
+	}
+
+	for {
+		select {
+		case msg := <-msgCh:
+			accumulate(msg)
+		case <-subsDone:
+			// subsDone stays ready forever once closed, so a plain select
+			// against msgCh could pick it while messages are still
+			// buffered. Drain whatever's left before reporting.
+			for {
+				select {
+				case msg := <-msgCh:
+					accumulate(msg)
+				default:
+					out <- benchStats{kind: "sub", id: id, count: count, bytes: bytes, elapsed: time.Since(start), latencies: latencies}
+					return
+				}
+			}
+		}
+	}
+}
+
+// benchRequester issues msgCount/numPubs blocking requests against subj,
+// timing each round trip directly.
+func benchRequester(nc *nats.Conn, o benchOpts, id int, wg, producers *sync.WaitGroup, out chan<- benchStats) {
+	defer wg.Done()
+	defer producers.Done()
+
+	n := o.msgCount / o.numPubs
+	payload := make([]byte, o.msgSize)
+	var bytes int64
+	var latencies []time.Duration
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		reqStart := time.Now()
+		msg, err := nc.Request(o.subj, payload, 5*time.Second)
+		if err != nil {
+			log.Printf("req[%d]: %v", id, err)
+			continue
+		}
+		latencies = append(latencies, time.Since(reqStart))
+		bytes += int64(len(msg.Data))
+	}
+	out <- benchStats{kind: "req", id: id, count: len(latencies), bytes: bytes, elapsed: time.Since(start), latencies: latencies}
+}
+
+// reportBench logs a per-goroutine line followed by the aggregate
+// throughput and latency percentiles across the whole run.
+func reportBench(all []benchStats) {
+	var totalCount int
+	var totalBytes int64
+	var maxElapsed time.Duration
+	var allLatencies []time.Duration
+
+	for _, s := range all {
+		log.Printf("[%s-%d] %d msgs, %.2f MB in %v (%.0f msgs/sec)",
+			s.kind, s.id, s.count, mb(s.bytes), s.elapsed, rate(s.count, s.elapsed))
+		totalCount += s.count
+		totalBytes += s.bytes
+		if s.elapsed > maxElapsed {
+			maxElapsed = s.elapsed
+		}
+		allLatencies = append(allLatencies, s.latencies...)
+	}
+
+	log.Printf("Aggregate: %d msgs, %.2f MB in %v (%.0f msgs/sec, %.2f MB/sec)",
+		totalCount, mb(totalBytes), maxElapsed, rate(totalCount, maxElapsed), mbRate(totalBytes, maxElapsed))
+
+	if len(allLatencies) == 0 {
+		return
+	}
+	sort.Slice(allLatencies, func(i, j int) bool { return allLatencies[i] < allLatencies[j] })
+	log.Printf("Latency: p50=%v p90=%v p99=%v",
+		percentile(allLatencies, 50), percentile(allLatencies, 90), percentile(allLatencies, 99))
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (p * len(sorted)) / 100
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func rate(count int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+func mb(bytes int64) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
+
+func mbRate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return mb(bytes) / elapsed.Seconds()
+}
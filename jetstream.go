@@ -0,0 +1,116 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// jsStreamName derives a stream name from the subject when -stream wasn't
+// given, since -create-stream needs something to call it.
+func jsStreamName(stream, subject string) string {
+	if stream != "" {
+		return stream
+	}
+	name := strings.NewReplacer(".", "_", "*", "any", ">", "rest").Replace(subject)
+	return strings.Trim(name, "_")
+}
+
+// parseRetention maps the -retention flag to a nats.RetentionPolicy.
+func parseRetention(s string) (nats.RetentionPolicy, error) {
+	switch s {
+	case "", "limits":
+		return nats.LimitsPolicy, nil
+	case "interest":
+		return nats.InterestPolicy, nil
+	case "workqueue":
+		return nats.WorkQueuePolicy, nil
+	}
+	return 0, fmt.Errorf("unknown -retention %q (want limits, interest or workqueue)", s)
+}
+
+// ensureStream creates cfg if a stream by that name doesn't already exist.
+func ensureStream(js nats.JetStreamContext, cfg *nats.StreamConfig) error {
+	if _, err := js.StreamInfo(cfg.Name); err == nil {
+		return nil
+	}
+	_, err := js.AddStream(cfg)
+	if err != nil {
+		return fmt.Errorf("create stream %q: %v", cfg.Name, err)
+	}
+	log.Printf("Created stream [%s] subjects=%v", cfg.Name, cfg.Subjects)
+	return nil
+}
+
+// jsPublish publishes msg through JetStream and reports the resulting PubAck.
+func jsPublish(js nats.JetStreamContext, subj string, msg *nats.Msg) error {
+	msg.Subject = subj
+	ack, err := js.PublishMsg(msg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Published to stream [%s] at sequence [%d]", ack.Stream, ack.Sequence)
+	return nil
+}
+
+// jsSubscribe creates either a durable pull consumer or an ephemeral push
+// consumer, depending on whether durable was given, and delivers messages to
+// cb with manual ack.
+func jsSubscribe(js nats.JetStreamContext, subj, durable string, ackWait time.Duration, cb nats.MsgHandler) (func(), error) {
+	if durable != "" {
+		sub, err := js.PullSubscribe(subj, durable, nats.ManualAck(), nats.AckWait(ackWait))
+		if err != nil {
+			return nil, err
+		}
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+				if err != nil {
+					continue
+				}
+				for _, msg := range msgs {
+					cb(msg)
+				}
+			}
+		}()
+		return func() { close(stop) }, nil
+	}
+
+	sub, err := js.Subscribe(subj, cb, nats.ManualAck(), nats.AckWait(ackWait))
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+// printJSMeta logs the stream/consumer sequence for a JetStream message, in
+// addition to whatever printMsg already prints for it.
+func printJSMeta(msg *nats.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return
+	}
+	log.Printf("  stream: %s consumer: %s seq: %d/%d", meta.Stream, meta.Consumer, meta.Sequence.Stream, meta.Sequence.Consumer)
+}
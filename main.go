@@ -14,16 +14,23 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 const version = "0.3.0"
@@ -31,13 +38,15 @@ const version = "0.3.0"
 func usage(exeType int) {
 	switch exeType {
 	case subExe:
-		log.Printf("Usage: nats-sub [-s server] [-creds file] [-t] <subject>\n")
+		log.Printf("Usage: nats-sub [-s server] [-creds file | -nkey file | -jwt file] [-t] [-o text|json] <subject> [subject...]\n")
 	case reqExe:
-		log.Printf("Usage: nats-req [-s server] [-creds file] [-t] <subject> <request>\n")
+		log.Printf("Usage: nats-req [-s server] [-creds file | -nkey file | -jwt file] [-t] [-H \"K: V\"] [-f file] <subject> [request]\n")
 	case repExe:
-		log.Printf("Usage: nats-rply [-s server] [-creds file] [-t] [-q queue] <subject> <response>\n")
+		log.Printf("Usage: nats-rply [-s server] [-creds file | -nkey file | -jwt file] [-t] [-q queue] [-H \"K: V\"] [-f file] <subject> [response]\n")
+	case benchExe:
+		log.Printf("Usage: nats-bench [-s server] [-creds file | -nkey file | -jwt file] [-n count] [-ms size] [-np pubs] [-ns subs] [-mode pub|sub|pubsub|req] [-q queue] [-js] <subject>\n")
 	default:
-		log.Printf("Usage: nats-pub [-s server] [-creds file] [-t] <subject> <msg>\n")
+		log.Printf("Usage: nats-pub [-s server] [-creds file | -nkey file | -jwt file] [-t] [-H \"K: V\"] [-f file] <subject> [msg]\n")
 	}
 	flag.PrintDefaults()
 }
@@ -45,11 +54,33 @@ func usage(exeType int) {
 func main() {
 	var urls = flag.String("s", stringFromEnv("NATS_URL", "connect.ngs.global"), "The NATS System")
 	var userCreds = flag.String("creds", stringFromEnv("NATS_CREDS", ""), "User Credentials File")
+	var nkeyFile = flag.String("nkey", stringFromEnv("NATS_NKEY", ""), "NKey Seed File")
+	var jwtFile = flag.String("jwt", stringFromEnv("NATS_JWT", ""), "User JWT File")
 	var queue = flag.String("q", "NATS-RPLY-22", "Queue Group Name")
 	var showTime = flag.Bool("t", false, "Display timestamps")
 	var showHelp = flag.Bool("h", false, "Show help message")
 	var showVersion = flag.Bool("v", false, "Show version")
 
+	var useJS = flag.Bool("js", false, "Use JetStream for publish/subscribe")
+	var stream = flag.String("stream", "", "JetStream stream name (default: derived from the subject)")
+	var durable = flag.String("durable", "", "Durable consumer name (JetStream subscribe only; ephemeral if empty)")
+	var ackWait = flag.Duration("ack-wait", 30*time.Second, "JetStream consumer ack wait")
+	var createStream = flag.Bool("create-stream", false, "Create -stream if it doesn't already exist")
+	var streamSubjects = flag.String("subjects", "", "Comma-separated subjects for -create-stream (default: the pub/sub subject arguments)")
+	var retention = flag.String("retention", "limits", "Stream retention policy for -create-stream: limits, interest or workqueue")
+	var maxBytes = flag.Int64("maxbytes", -1, "Max stream size in bytes for -create-stream (-1 for unlimited)")
+
+	var headerFlags headerList
+	flag.Var(&headerFlags, "H", "Message header 'Key: Value' (repeatable)")
+	var payloadFile = flag.String("f", "", "Read the message body from file, or '-' for stdin")
+	var outputMode = flag.String("o", "text", "nats-sub output format: text or json")
+
+	var benchCount = flag.Int("n", 100000, "nats-bench: total number of messages, split across publishers/requesters")
+	var benchSize = flag.Int("ms", 128, "nats-bench: message size in bytes")
+	var benchPubs = flag.Int("np", 1, "nats-bench: number of concurrent publishers/requesters")
+	var benchSubs = flag.Int("ns", 1, "nats-bench: number of concurrent subscribers")
+	var benchMode = flag.String("mode", "pubsub", "nats-bench: pub, sub, pubsub or req")
+
 	exeType := exeType()
 
 	log.SetFlags(0)
@@ -68,18 +99,40 @@ func main() {
 
 	args := flag.Args()
 
-	if exeType != subExe && len(args) != 2 || exeType == subExe && len(args) != 1 {
-		usage(exeType)
-		os.Exit(1)
+	switch {
+	case exeType == subExe:
+		if len(args) < 1 {
+			usage(exeType)
+			os.Exit(1)
+		}
+	case exeType == benchExe || *payloadFile != "":
+		if len(args) != 1 {
+			usage(exeType)
+			os.Exit(1)
+		}
+	default:
+		if len(args) != 2 {
+			usage(exeType)
+			os.Exit(1)
+		}
+	}
+
+	authOpt, err := authOption(*userCreds, *nkeyFile, *jwtFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hdr, err := parseHeaders(headerFlags)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Connect Options.
 	opts := []nats.Option{nats.Name(toolName(exeType))}
 	opts = setupConnOptions(opts)
 
-	// Use UserCredentials
-	if *userCreds != "" {
-		opts = append(opts, nats.UserCredentials(*userCreds))
+	if authOpt != nil {
+		opts = append(opts, authOpt)
 	}
 
 	us := *urls
@@ -93,38 +146,112 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var js nats.JetStreamContext
+	if *useJS {
+		js, err = nc.JetStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *createStream && (exeType == pubExe || exeType == subExe) {
+			policy, err := parseRetention(*retention)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Default to every subject nats-sub was given (pubExe only
+			// ever has the one), so -create-stream covers all of them
+			// when -js subscribes to each in turn below.
+			subjects := args
+			if exeType == pubExe {
+				subjects = args[:1]
+			}
+			if *streamSubjects != "" {
+				subjects = strings.Split(*streamSubjects, ",")
+			}
+			cfg := &nats.StreamConfig{
+				Name:      jsStreamName(*stream, args[0]),
+				Subjects:  subjects,
+				Retention: policy,
+				MaxBytes:  *maxBytes,
+			}
+			if err := ensureStream(js, cfg); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
 	switch exeType {
 	case subExe:
-		subj, i := args[0], 0
+		if *outputMode != "text" && *outputMode != "json" {
+			log.Fatalf("unknown -o %q (want text or json)", *outputMode)
+		}
 
-		nc.Subscribe(subj, func(msg *nats.Msg) {
-			i++
-			printMsg(msg, i)
-		})
-		nc.Flush()
-		if err := nc.LastError(); err != nil {
-			log.Fatal(err)
+		var seq int64
+		recv := func(msg *nats.Msg) {
+			n := int(atomic.AddInt64(&seq, 1))
+			if *outputMode == "json" {
+				printMsgJSON(msg, n)
+				return
+			}
+			printMsg(msg, n)
+			if *useJS {
+				printJSMeta(msg)
+			}
+		}
+
+		for si, subj := range args {
+			subj := subj
+			if *useJS {
+				durable := *durable
+				if durable != "" && len(args) > 1 {
+					durable = fmt.Sprintf("%s-%d", durable, si)
+				}
+				stop, err := jsSubscribe(js, subj, durable, *ackWait, func(msg *nats.Msg) {
+					recv(msg)
+					msg.Ack()
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer stop()
+			} else {
+				nc.Subscribe(subj, recv)
+			}
+			log.Printf("Listening on [%s]", subj)
+		}
+		if !*useJS {
+			nc.Flush()
+			if err := nc.LastError(); err != nil {
+				log.Fatal(err)
+			}
 		}
-		log.Printf("Listening on [%s]", subj)
 		if *showTime {
 			log.SetFlags(log.LstdFlags)
 		}
 	case reqExe:
-		subj, reqMsg := args[0], []byte(args[1])
-		msg, err := nc.Request(subj, reqMsg, 2*time.Second)
+		subj := args[0]
+		reqPayload, err := loadPayload(args, *payloadFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		msg, err := nc.RequestMsg(&nats.Msg{Subject: subj, Data: reqPayload, Header: hdr}, 2*time.Second)
 		if err != nil {
 			if nc.LastError() != nil {
 				log.Fatalf("%v for request", nc.LastError())
 			}
 			log.Fatalf("%v for request", err)
 		}
+		printHeaders(msg)
 		fmt.Printf("%s\n", msg.Data)
 	case repExe:
-		subj, repMsg, i := args[0], []byte(args[1]), 0
+		subj, i := args[0], 0
+		repPayload, err := loadPayload(args, *payloadFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 		nc.QueueSubscribe(subj, *queue, func(msg *nats.Msg) {
 			i++
 			printMsg(msg, i)
-			msg.Respond(repMsg)
+			msg.RespondMsg(&nats.Msg{Data: repPayload, Header: hdr})
 		})
 		nc.Flush()
 		if err := nc.LastError(); err != nil {
@@ -134,22 +261,208 @@ func main() {
 		if *showTime {
 			log.SetFlags(log.LstdFlags)
 		}
+	case benchExe:
+		switch *benchMode {
+		case "pub", "sub", "pubsub", "req":
+		default:
+			log.Fatalf("unknown -mode %q (want pub, sub, pubsub or req)", *benchMode)
+		}
+		runBench(nc, js, benchOpts{
+			subj:     args[0],
+			msgCount: *benchCount,
+			msgSize:  *benchSize,
+			numPubs:  *benchPubs,
+			numSubs:  *benchSubs,
+			mode:     *benchMode,
+			queue:    *queue,
+			useJS:    *useJS,
+		})
 	default:
-		subj, msg := args[0], []byte(args[1])
-		nc.Publish(subj, msg)
-		nc.Flush()
-		if err := nc.LastError(); err != nil {
+		subj := args[0]
+		payload, err := loadPayload(args, *payloadFile)
+		if err != nil {
 			log.Fatal(err)
 		}
+		msg := &nats.Msg{Subject: subj, Data: payload, Header: hdr}
+		if *useJS {
+			if err := jsPublish(js, subj, msg); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			if err := nc.PublishMsg(msg); err != nil {
+				log.Fatal(err)
+			}
+			nc.Flush()
+			if err := nc.LastError(); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
 	if exeType == subExe || exeType == repExe {
-		runtime.Goexit()
+		waitForShutdown(nc)
+	}
+}
+
+// waitForShutdown blocks until SIGINT/SIGTERM is received, then drains the
+// connection so in-flight messages (and, for queue subscribers, pending
+// responses) are processed before the process exits.
+func waitForShutdown(nc *nats.Conn) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	log.Printf("Draining...")
+	if err := nc.Drain(); err != nil {
+		log.Fatalf("Error draining: %v", err)
+	}
+	for nc.IsDraining() {
+		time.Sleep(10 * time.Millisecond)
 	}
+	log.Printf("Drained, exiting")
 }
 
 func printMsg(m *nats.Msg, i int) {
 	log.Printf("[#%d] Received on [%s]: '%s'", i, m.Subject, m.Data)
+	printHeaders(m)
+}
+
+// printHeaders dumps any NATS message headers, one per line.
+func printHeaders(m *nats.Msg) {
+	for k, vs := range m.Header {
+		for _, v := range vs {
+			log.Printf("  %s: %s", k, v)
+		}
+	}
+}
+
+// jsonMsg is the newline-delimited JSON record nats-sub emits in -o json
+// mode, one per received message.
+type jsonMsg struct {
+	Subject   string              `json:"subject"`
+	Reply     string              `json:"reply,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Data      string              `json:"data"`
+	Base64    bool                `json:"base64,omitempty"`
+	Timestamp time.Time           `json:"timestamp"`
+	Seq       int                 `json:"seq"`
+}
+
+// printMsgJSON writes m as a single newline-delimited JSON record to
+// stdout, so nats-sub output can be piped straight into jq or a log
+// pipeline. Data is kept as a plain string when it's valid UTF-8, and
+// base64-encoded (with base64:true) otherwise.
+func printMsgJSON(m *nats.Msg, seq int) {
+	jm := jsonMsg{
+		Subject:   m.Subject,
+		Reply:     m.Reply,
+		Timestamp: time.Now(),
+		Seq:       seq,
+	}
+	if len(m.Header) > 0 {
+		jm.Headers = map[string][]string(m.Header)
+	}
+	if utf8.Valid(m.Data) {
+		jm.Data = string(m.Data)
+	} else {
+		jm.Data = base64.StdEncoding.EncodeToString(m.Data)
+		jm.Base64 = true
+	}
+
+	b, err := json.Marshal(jm)
+	if err != nil {
+		log.Printf("json marshal: %v", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// headerList collects repeated -H "Key: Value" flags.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ",") }
+
+func (h *headerList) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+// parseHeaders turns "Key: Value" flag values into a nats.Header, or nil if
+// none were given.
+func parseHeaders(raw []string) (nats.Header, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	hdr := nats.Header{}
+	for _, kv := range raw {
+		parts := strings.SplitN(kv, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid -H %q, want \"Key: Value\"", kv)
+		}
+		hdr.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return hdr, nil
+}
+
+// loadPayload returns the message body: from -f (or stdin, for "-") if set,
+// otherwise the trailing positional argument.
+func loadPayload(args []string, file string) ([]byte, error) {
+	if file != "" {
+		if file == "-" {
+			return ioutil.ReadAll(os.Stdin)
+		}
+		return ioutil.ReadFile(file)
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("message required as an argument, or use -f")
+	}
+	return []byte(args[1]), nil
+}
+
+// authOption builds the nats.Option(s) for whichever auth mode was requested.
+// -creds is mutually exclusive with -nkey/-jwt, but -nkey and -jwt may be
+// combined, since a bare user JWT needs an NKey to sign the server nonce.
+func authOption(credsFile, nkeyFile, jwtFile string) (nats.Option, error) {
+	if credsFile != "" && (nkeyFile != "" || jwtFile != "") {
+		return nil, fmt.Errorf("-creds cannot be combined with -nkey or -jwt")
+	}
+	if credsFile != "" {
+		return nats.UserCredentials(credsFile), nil
+	}
+
+	if jwtFile == "" {
+		if nkeyFile == "" {
+			return nil, nil
+		}
+		opt, err := nats.NkeyOptionFromSeed(nkeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("nkey seed file %q: %v", nkeyFile, err)
+		}
+		return opt, nil
+	}
+	if nkeyFile == "" {
+		return nil, fmt.Errorf("-jwt requires a matching -nkey seed file for signing")
+	}
+
+	jwt, err := ioutil.ReadFile(jwtFile)
+	if err != nil {
+		return nil, fmt.Errorf("jwt file %q: %v", jwtFile, err)
+	}
+	seed, err := ioutil.ReadFile(nkeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("nkey seed file %q: %v", nkeyFile, err)
+	}
+	kp, err := nkeys.ParseDecoratedNKey(seed)
+	if err != nil {
+		return nil, fmt.Errorf("nkey seed file %q: %v", nkeyFile, err)
+	}
+	// Sign the server nonce straight from the seed rather than going
+	// through NkeyOptionFromSeed, which also sets Options.Nkey - nats.Connect
+	// rejects a connection that has both UserJWT and Nkey set.
+	return nats.UserJWT(
+		func() (string, error) { return strings.TrimSpace(string(jwt)), nil },
+		func(nonce []byte) ([]byte, error) { return kp.Sign(nonce) },
+	), nil
 }
 
 // Mostly for nats-sub only.
@@ -166,7 +479,11 @@ func setupConnOptions(opts []nats.Option) []nats.Option {
 		log.Printf("Reconnected [%s]", nc.ConnectedUrl())
 	}))
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
-		log.Fatalf("Exiting: %v", nc.LastError())
+		if err := nc.LastError(); err != nil {
+			log.Printf("Exiting: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}))
 	return opts
 }
@@ -176,6 +493,7 @@ const (
 	subExe
 	reqExe
 	repExe
+	benchExe
 )
 
 func exeType() int {
@@ -183,6 +501,9 @@ func exeType() int {
 	if len(exeName) < 7 {
 		return pubExe
 	}
+	if strings.HasSuffix(exeName, "bench") {
+		return benchExe
+	}
 	switch exeName[len(exeName)-4:] {
 	case "-pub":
 		return pubExe
@@ -204,6 +525,8 @@ func toolName(exeType int) string {
 		return "NATS-REQ TOOL"
 	case repExe:
 		return "NATS-RPLY TOOL"
+	case benchExe:
+		return "NATS-BENCH TOOL"
 	default:
 		return "NATS-PUB TOOL"
 	}